@@ -4,6 +4,10 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -15,19 +19,34 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/caarlos0/env/v6"
+	"github.com/charmbracelet/charm/client/keyprovider"
 	charm "github.com/charmbracelet/charm/proto"
 	"github.com/charmbracelet/keygen"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/kevinburke/ssh_config"
 	"github.com/mitchellh/go-homedir"
 	gap "github.com/muesli/go-app-paths"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var nameValidator = regexp.MustCompile("^[a-zA-Z0-9]{1,50}$")
 
+// ErrHostKeyChanged is returned when the key presented by the Charm server
+// no longer matches the key we've pinned for it in the known hosts file.
+// This usually means either the server was re-keyed or someone is trying to
+// impersonate it.
+var ErrHostKeyChanged = errors.New("host key mismatch: the key offered by the server does not match the pinned known host key")
+
+// ErrAuthFailed is returned by sshSession when the SSH key exchange
+// succeeds but the server rejects the user's keys. Unlike a network
+// failure, retrying without changing credentials won't help.
+var ErrAuthFailed = errors.New("authentication failed: the server rejected all offered keys")
+
 // Config contains the Charm client configuration.
 type Config struct {
 	Host         string `env:"CHARM_HOST" envDefault:"cloud.charm.sh"`
@@ -40,6 +59,81 @@ type Config struct {
 	IdentityKey  string `env:"CHARM_IDENTITY_KEY"`
 	UseSSHAgent  bool   `env:"CHARM_USE_SSH_AGENT"`
 	SSHAgentAddr string `env:"CHARM_SSH_AGENT_ADDR"`
+
+	// KnownHostsFile overrides where the server's pinned host key is stored.
+	// Defaults to "charm_known_hosts" under DataPath().
+	KnownHostsFile string `env:"CHARM_KNOWN_HOSTS_FILE"`
+
+	// InsecureSkipHostKeyCheck disables host key verification entirely. This
+	// is insecure and should only be used for local development.
+	InsecureSkipHostKeyCheck bool `env:"CHARM_INSECURE_SKIP_HOST_KEY_CHECK"`
+
+	// PassphraseCallback is called to obtain the decryption passphrase for
+	// an encrypted private key found at path. It's only consulted when the
+	// key isn't already held by a running ssh-agent.
+	PassphraseCallback func(path string) ([]byte, error)
+
+	// UseCertificateAuth authenticates with a short-lived SSH certificate
+	// signed by the Charm server's CA instead of a raw public key. This
+	// lets a Charm server trust a single CA key rather than maintaining
+	// per-user authorized_keys entries.
+	UseCertificateAuth bool `env:"CHARM_USE_CERTIFICATE_AUTH"`
+
+	// CertRefreshSkew is how much time before a cached certificate's expiry
+	// we'll proactively request a new one. Defaults to defaultCertRefreshSkew
+	// when zero.
+	CertRefreshSkew time.Duration `env:"CHARM_CERT_REFRESH_SKEW"`
+
+	// KeyProviders, when set, replaces the default file+agent key lookup
+	// with an arbitrary set of signer sources (e.g. a KMS or hardware
+	// token). Leave nil to use the default behavior.
+	KeyProviders []keyprovider.KeyProvider
+}
+
+// certValidity is how long a requested user certificate is valid for.
+const certValidity = 24 * time.Hour
+
+// defaultCertRefreshSkew is how much time before a cached certificate's
+// expiry we'll proactively request a new one, used when Config.CertRefreshSkew
+// is left at its zero value.
+const defaultCertRefreshSkew = 1 * time.Hour
+
+// certAuthEntry caches the ephemeral signer and certificate used for
+// certificate-based auth for a single Charm host, for the lifetime of the
+// process, so repeated NewClient calls for that host don't re-request a
+// cert. Its own lock lets requests for different hosts proceed (and make
+// their network round-trip to RequestUserCertificate) without blocking on
+// each other.
+type certAuthEntry struct {
+	sync.Mutex
+	signer ssh.Signer
+	cert   *ssh.Certificate
+}
+
+var (
+	certAuthMu     sync.Mutex
+	certAuthByHost = map[string]*certAuthEntry{}
+)
+
+// certAuthFor returns the certAuthEntry for host, creating it if needed.
+func certAuthFor(host string) *certAuthEntry {
+	certAuthMu.Lock()
+	defer certAuthMu.Unlock()
+	entry, ok := certAuthByHost[host]
+	if !ok {
+		entry = &certAuthEntry{}
+		certAuthByHost[host] = entry
+	}
+	return entry
+}
+
+// defaultIdentityFiles are the personal SSH keys we'll try, in order, when
+// ssh_config doesn't name an IdentityFile for the configured host.
+var defaultIdentityFiles = []string{
+	"~/.ssh/id_ed25519",
+	"~/.ssh/id_rsa",
+	"~/.ssh/id_ecdsa",
+	"~/.ssh/identity",
 }
 
 // Client is the Charm client.
@@ -77,7 +171,7 @@ func NewClient(cfg *Config) (*Client, error) {
 	var err error
 	if cfg.IdentityKey != "" {
 		sshKeys = []string{cfg.IdentityKey}
-	} else {
+	} else if len(cfg.KeyProviders) == 0 {
 		sshKeys, err = cc.findAuthKeys(cfg.KeyType)
 		if err != nil {
 			return nil, err
@@ -96,38 +190,332 @@ func NewClient(cfg *Config) (*Client, error) {
 				return nil, err
 			}
 		}
+		sshKeys = append(sshKeys, cc.identityFiles()...)
 	}
 
-	var pkam []ssh.AuthMethod // nolint:prealloc
+	var agentClient agent.ExtendedAgent
 	if cfg.UseSSHAgent {
 		conn, err := getLocalAgentConn(cfg)
 		if err != nil {
 			return nil, err
 		}
 		cc.closer = conn.Close
-		pkam = append(pkam, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		agentClient = agent.NewClient(conn)
+	}
+
+	providers := cfg.KeyProviders
+	if len(providers) == 0 {
+		if agentClient != nil {
+			providers = append(providers, keyprovider.NewAgentProvider(agentClient))
+		}
+		fileProvider := keyprovider.NewFileProvider(sshKeys, cfg.PassphraseCallback)
+		fileProvider.Agent = agentClient
+		providers = append(providers, fileProvider)
 	}
 
-	for _, k := range sshKeys {
-		m, err := publicKeyAuthMethod(k)
+	var pkam []ssh.AuthMethod // nolint:prealloc
+	for _, p := range providers {
+		signers, err := p.Signers()
 		if err != nil {
 			return nil, err
 		}
-		pkam = append(pkam, m)
+		for _, s := range signers {
+			pkam = append(pkam, ssh.PublicKeys(s))
+		}
 	}
 
 	if len(pkam) == 0 {
 		return nil, charm.ErrMissingSSHAuth
 	}
 
+	hostKeyCallback, err := cc.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
 	cc.sshConfig = &ssh.ClientConfig{
 		User:            "charm",
 		Auth:            pkam,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // nolint
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	if cfg.UseCertificateAuth {
+		certSigner, err := cc.certificateAuthMethod(agentClient)
+		if err != nil {
+			return nil, err
+		}
+		cc.sshConfig.Auth = []ssh.AuthMethod{certSigner}
 	}
+
 	return cc, nil
 }
 
+// certificateAuthMethod returns an ssh.AuthMethod backed by a short-lived
+// certificate signed by the Charm server's CA, requesting (and caching)
+// one if needed. It authenticates the signing request itself using the
+// client's already-configured key-based auth.
+func (cc *Client) certificateAuthMethod(agentClient agent.ExtendedAgent) (ssh.AuthMethod, error) {
+	entry := certAuthFor(cc.Config.Host)
+	entry.Lock()
+	defer entry.Unlock()
+
+	skew := cc.Config.CertRefreshSkew
+	if skew == 0 {
+		skew = defaultCertRefreshSkew
+	}
+
+	if entry.cert == nil {
+		// No cert cached in this process yet: see if an earlier process
+		// left one on disk whose matching ephemeral key is still held by
+		// the running ssh-agent.
+		if cert, signer, err := cc.loadPersistedCert(agentClient); err == nil && cert != nil {
+			entry.cert = cert
+			entry.signer = signer
+		}
+	}
+
+	if entry.cert != nil && time.Now().Add(skew).Before(time.Unix(int64(entry.cert.ValidBefore), 0)) {
+		return ssh.PublicKeys(entry.signer), nil
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := cc.RequestUserCertificate(signer.PublicKey(), []string{"charm"}, certValidity)
+	if err != nil {
+		return nil, err
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cc.persistCertificate(cert); err != nil {
+		return nil, err
+	}
+	if agentClient != nil {
+		lifetime := time.Until(time.Unix(int64(cert.ValidBefore), 0))
+		_ = agentClient.Add(agent.AddedKey{
+			PrivateKey:   priv,
+			Certificate:  cert,
+			LifetimeSecs: uint32(lifetime.Seconds()),
+		})
+	}
+
+	entry.signer = certSigner
+	entry.cert = cert
+	return ssh.PublicKeys(certSigner), nil
+}
+
+// persistCertificate writes cert to disk so a later process sharing this
+// DataPath can recognize it via loadPersistedCert, rather than requesting a
+// fresh one immediately on every restart.
+func (cc *Client) persistCertificate(cert *ssh.Certificate) error {
+	dp, err := cc.DataPath()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dp, "charm-cert.pub"), ssh.MarshalAuthorizedKey(cert), 0o600)
+}
+
+// loadPersistedCert loads the certificate written by persistCertificate, if
+// any, and reports it as usable only when it's still valid and the running
+// ssh-agent holds a signer for it. The cert's ephemeral private key is
+// never written to disk, so without a matching agent-held signer the
+// persisted cert can't actually be used to authenticate and is ignored.
+func (cc *Client) loadPersistedCert(agentClient agent.ExtendedAgent) (*ssh.Certificate, ssh.Signer, error) {
+	if agentClient == nil {
+		return nil, nil, nil
+	}
+
+	dp, err := cc.DataPath()
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dp, "charm-cert.pub"))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, nil, nil // nolint:nilerr
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok || time.Now().After(time.Unix(int64(cert.ValidBefore), 0)) {
+		return nil, nil, nil
+	}
+
+	signers, err := agentClient.Signers()
+	if err != nil {
+		return nil, nil, nil // nolint:nilerr
+	}
+	for _, s := range signers {
+		if bytes.Equal(s.PublicKey().Marshal(), cert.Marshal()) {
+			return cert, s, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// userCertRequest is the payload sent to the server's api-sign-cert verb.
+type userCertRequest struct {
+	PublicKey  string        `json:"public_key"`
+	Principals []string      `json:"principals"`
+	Validity   time.Duration `json:"validity"`
+}
+
+// RequestUserCertificate asks the Charm server's CA to sign pub as a user
+// certificate valid for principals, for the given validity period. The
+// request is sent over the client's existing authenticated SSH session.
+func (cc *Client) RequestUserCertificate(pub ssh.PublicKey, principals []string, validity time.Duration) (*ssh.Certificate, error) {
+	s, err := cc.sshSession(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close() // nolint:errcheck
+
+	req := userCertRequest{
+		PublicKey:  keyText(pub),
+		Principals: principals,
+		Validity:   validity,
+	}
+	j, err := json.Marshal(&req)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.Output(fmt.Sprintf("api-sign-cert %s", string(j)))
+	if err != nil {
+		return nil, err
+	}
+	signed, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse signed certificate: %w", err)
+	}
+	cert, ok := signed.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("server did not return a signed certificate")
+	}
+	return cert, nil
+}
+
+// knownHostsPath returns the path to the file used to pin the Charm server's
+// host key, respecting Config.KnownHostsFile when set.
+func (cc *Client) knownHostsPath() (string, error) {
+	if cc.Config.KnownHostsFile != "" {
+		return homedir.Expand(cc.Config.KnownHostsFile)
+	}
+	dp, err := cc.DataPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dp, "charm_known_hosts"), nil
+}
+
+// hostKeyCallback builds the ssh.HostKeyCallback used to verify the Charm
+// server's identity. On first successful connection to a host, its key is
+// pinned into the known hosts file; on every later connection, the
+// server's key must match what's pinned or ErrHostKeyChanged is returned.
+//
+// The callback re-parses the known hosts file on every dial rather than
+// once up front, so a key pinned by an earlier dial from this same Client
+// (or another process) is checked against, instead of a stale in-memory
+// snapshot from before that key existed.
+func (cc *Client) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if cc.Config.InsecureSkipHostKeyCheck {
+		return ssh.InsecureIgnoreHostKey(), nil // nolint
+	}
+
+	khPath, err := cc.knownHostsPath()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(khPath), 0o700); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(khPath); os.IsNotExist(err) {
+		f, err := os.OpenFile(khPath, os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		f.Close() // nolint:errcheck
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		verify, err := knownhosts.New(khPath)
+		if err != nil {
+			return err
+		}
+		err = verify(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			// No key pinned for this host yet: trust it on first use.
+			return pinHostKey(khPath, hostname, key)
+		}
+		return ErrHostKeyChanged
+	}, nil
+}
+
+// pinHostKey appends the given host key to the known hosts file, keyed by
+// hostname so it's found again regardless of which IP the host later
+// resolves to.
+func pinHostKey(khPath string, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(khPath, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint:errcheck
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	_, err = fmt.Fprintln(f, line)
+	return err
+}
+
+// ResetKnownHost removes the pinned host key for the client's configured
+// host, so the next connection will trust-on-first-use whatever key the
+// server presents. Use this to rotate a key after confirming out-of-band
+// that the server's key has legitimately changed.
+func (cc *Client) ResetKnownHost() error {
+	khPath, err := cc.knownHostsPath()
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(khPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(cc.Config.Host, fmt.Sprintf("%d", cc.Config.SSHPort))
+	norm := knownhosts.Normalize(addr)
+
+	var kept []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == norm {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return ioutil.WriteFile(khPath, []byte(strings.Join(kept, "\n")+"\n"), 0o600)
+}
+
 // getLocalAgentConn checks if there's a local agent at $SSH_AUTH_SOCK and, if so,
 // returns a connection to it through agent.Agent.
 func getLocalAgentConn(cfg *Config) (net.Conn, error) {
@@ -168,7 +556,7 @@ func (cc *Client) Close() error {
 
 // JWT returns a JSON web token for the user.
 func (cc *Client) JWT(aud ...string) (string, error) {
-	s, err := cc.sshSession()
+	s, err := cc.sshSession(context.Background())
 	if err != nil {
 		return "", err
 	}
@@ -181,8 +569,8 @@ func (cc *Client) JWT(aud ...string) (string, error) {
 }
 
 // ID returns the user's ID.
-func (cc *Client) ID() (string, error) {
-	s, err := cc.sshSession()
+func (cc *Client) ID(ctx context.Context) (string, error) {
+	s, err := cc.sshSession(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -196,7 +584,7 @@ func (cc *Client) ID() (string, error) {
 
 // AuthorizedKeys returns the keys linked to a user's account.
 func (cc *Client) AuthorizedKeys() (string, error) {
-	s, err := cc.sshSession()
+	s, err := cc.sshSession(context.Background())
 	if err != nil {
 		return "", err
 	}
@@ -210,7 +598,7 @@ func (cc *Client) AuthorizedKeys() (string, error) {
 
 // LinkKeyToUser links the given authorized key to the current user.
 func (cc *Client) LinkKeyToUser(key ssh.PublicKey) error {
-	s, err := cc.sshSession()
+	s, err := cc.sshSession(context.Background())
 	if err != nil {
 		return err
 	}
@@ -245,7 +633,7 @@ func keyText(key ssh.PublicKey) string {
 
 // AuthorizedKeysWithMetadata fetches keys linked to a user's account, with metadata.
 func (cc *Client) AuthorizedKeysWithMetadata() (*charm.Keys, error) {
-	s, err := cc.sshSession()
+	s, err := cc.sshSession(context.Background())
 	if err != nil {
 		return nil, err
 	}
@@ -263,7 +651,7 @@ func (cc *Client) AuthorizedKeysWithMetadata() (*charm.Keys, error) {
 
 // UnlinkAuthorizedKey removes an authorized key from the user's Charm account.
 func (cc *Client) UnlinkAuthorizedKey(key string) error {
-	s, err := cc.sshSession()
+	s, err := cc.sshSession(context.Background())
 	if err != nil {
 		return err
 	}
@@ -312,21 +700,22 @@ func (cc *Client) SetName(name string) (*charm.User, error) {
 	}
 	u := &charm.User{}
 	u.Name = name
-	err := cc.AuthedJSONRequest("POST", "/v1/bio", u, u)
+	err := cc.AuthedJSONRequest(context.Background(), "POST", "/v1/bio", u, u)
 	if err != nil {
 		return nil, err
 	}
 	return u, nil
 }
 
-// Bio returns the user's profile.
-func (cc *Client) Bio() (*charm.User, error) {
+// Bio returns the user's profile. It's cancelled if ctx is done before the
+// underlying SSH/HTTP calls complete.
+func (cc *Client) Bio(ctx context.Context) (*charm.User, error) {
 	u := &charm.User{}
-	id, err := cc.ID()
+	id, err := cc.ID(ctx)
 	if err != nil {
 		return nil, err
 	}
-	err = cc.AuthedJSONRequest("GET", fmt.Sprintf("/v1/id/%s", id), u, u)
+	err = cc.AuthedJSONRequest(ctx, "GET", fmt.Sprintf("/v1/id/%s", id), u, u)
 	if err != nil {
 		return nil, err
 	}
@@ -341,13 +730,33 @@ func ValidateName(name string) bool {
 	return nameValidator.MatchString(name)
 }
 
-func (cc *Client) sshSession() (*ssh.Session, error) {
+// sshSession dials the Charm server and opens a new SSH session. The dial
+// is cancelled if ctx is done first. If the key exchange succeeds but the
+// server rejects our keys, ErrAuthFailed is returned instead of the raw
+// SSH error so callers can distinguish it from a transient network issue.
+func (cc *Client) sshSession(ctx context.Context) (*ssh.Session, error) {
 	cfg := cc.Config
-	c, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", cfg.Host, cfg.SSHPort), cc.sshConfig)
+	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.SSHPort)
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close() // nolint:errcheck
+	}()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, cc.sshConfig)
 	if err != nil {
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, ErrAuthFailed
+		}
 		return nil, err
 	}
-	s, err := c.NewSession()
+
+	s, err := ssh.NewClient(sshConn, chans, reqs).NewSession()
 	if err != nil {
 		return nil, err
 	}
@@ -394,18 +803,36 @@ func (cc *Client) findAuthKeys(keyType string) (pathsToKeys []string, err error)
 	return found, nil
 }
 
-func publicKeyAuthMethod(kp string) (ssh.AuthMethod, error) {
-	keyPath, err := homedir.Expand(kp)
-	if err != nil {
-		return nil, err
+// identityFiles returns candidate personal SSH keys for the configured
+// host: first whatever ~/.ssh/config names as IdentityFile for that host,
+// falling back to the usual default key names if none apply.
+func (cc *Client) identityFiles() []string {
+	var files []string
+	for _, f := range ssh_config.DefaultUserSettings.GetAll(cc.Config.Host, "IdentityFile") {
+		if p, ok := existingExpandedPath(f); ok {
+			files = append(files, p)
+		}
 	}
-	key, err := ioutil.ReadFile(keyPath)
-	if err != nil {
-		return nil, err
+	if len(files) > 0 {
+		return files
+	}
+	for _, f := range defaultIdentityFiles {
+		if p, ok := existingExpandedPath(f); ok {
+			files = append(files, p)
+		}
 	}
-	signer, err := ssh.ParsePrivateKey(key)
+	return files
+}
+
+// existingExpandedPath expands ~ in p and reports whether the resulting
+// path exists on disk.
+func existingExpandedPath(p string) (string, bool) {
+	expanded, err := homedir.Expand(p)
 	if err != nil {
-		return nil, err
+		return "", false
+	}
+	if _, err := os.Stat(expanded); err != nil {
+		return "", false
 	}
-	return ssh.PublicKeys(signer), nil
+	return expanded, true
 }
@@ -0,0 +1,347 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kevinburke/ssh_config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestIdentityFilesFallsBackToDefaults(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	sshDir := filepath.Join(home, ".ssh")
+	if err := os.MkdirAll(sshDir, 0o700); err != nil {
+		t.Fatalf("mkdir .ssh: %v", err)
+	}
+	keyPath := filepath.Join(sshDir, "id_ed25519")
+	if err := os.WriteFile(keyPath, []byte("not a real key"), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+
+	cc := &Client{Config: &Config{Host: "example.com"}}
+	got := cc.identityFiles()
+	if len(got) != 1 || got[0] != keyPath {
+		t.Fatalf("identityFiles() = %v, want [%s]", got, keyPath)
+	}
+}
+
+func TestIdentityFilesFromSSHConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	sshDir := filepath.Join(home, ".ssh")
+	if err := os.MkdirAll(sshDir, 0o700); err != nil {
+		t.Fatalf("mkdir .ssh: %v", err)
+	}
+	keyPath := filepath.Join(sshDir, "work_key")
+	if err := os.WriteFile(keyPath, []byte("not a real key"), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	cfgPath := filepath.Join(sshDir, "config")
+	cfg := fmt.Sprintf("Host example.com\n  IdentityFile %s\n", keyPath)
+	if err := os.WriteFile(cfgPath, []byte(cfg), 0o600); err != nil {
+		t.Fatalf("write ssh config: %v", err)
+	}
+
+	orig := ssh_config.DefaultUserSettings
+	t.Cleanup(func() { ssh_config.DefaultUserSettings = orig })
+	ssh_config.DefaultUserSettings = &ssh_config.UserSettings{
+		UserConfigFinder: func() string { return cfgPath },
+	}
+
+	cc := &Client{Config: &Config{Host: "example.com"}}
+	got := cc.identityFiles()
+	if len(got) != 1 || got[0] != keyPath {
+		t.Fatalf("identityFiles() = %v, want [%s]", got, keyPath)
+	}
+}
+
+func TestIdentityFilesMultipleBlocksAndFiles(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	sshDir := filepath.Join(home, ".ssh")
+	if err := os.MkdirAll(sshDir, 0o700); err != nil {
+		t.Fatalf("mkdir .ssh: %v", err)
+	}
+
+	wildcardKey := filepath.Join(sshDir, "wildcard_key")
+	hostKeyA := filepath.Join(sshDir, "host_key_a")
+	hostKeyB := filepath.Join(sshDir, "host_key_b")
+	for _, p := range []string{wildcardKey, hostKeyA, hostKeyB} {
+		if err := os.WriteFile(p, []byte("not a real key"), 0o600); err != nil {
+			t.Fatalf("write key %s: %v", p, err)
+		}
+	}
+
+	cfgPath := filepath.Join(sshDir, "config")
+	cfg := fmt.Sprintf(
+		"Host *\n  IdentityFile %s\n\nHost example.com\n  IdentityFile %s\n  IdentityFile %s\n",
+		wildcardKey, hostKeyA, hostKeyB,
+	)
+	if err := os.WriteFile(cfgPath, []byte(cfg), 0o600); err != nil {
+		t.Fatalf("write ssh config: %v", err)
+	}
+
+	orig := ssh_config.DefaultUserSettings
+	t.Cleanup(func() { ssh_config.DefaultUserSettings = orig })
+	ssh_config.DefaultUserSettings = &ssh_config.UserSettings{
+		UserConfigFinder: func() string { return cfgPath },
+	}
+
+	cc := &Client{Config: &Config{Host: "example.com"}}
+	got := cc.identityFiles()
+	want := []string{hostKeyA, hostKeyB, wildcardKey}
+	if len(got) != len(want) {
+		t.Fatalf("identityFiles() = %v, want %v", got, want)
+	}
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			if g == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("identityFiles() = %v, missing %s", got, w)
+		}
+	}
+}
+
+func TestIdentityFilesSkipsMissingFiles(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	cc := &Client{Config: &Config{Host: "example.com"}}
+	if got := cc.identityFiles(); len(got) != 0 {
+		t.Fatalf("identityFiles() = %v, want none when no candidate exists", got)
+	}
+}
+
+// genHostKey returns a fresh ed25519 SSH public key, suitable for use as a
+// server host key in tests.
+func genHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("signer from host key: %v", err)
+	}
+	return signer.PublicKey()
+}
+
+// TestHostKeyCallbackRejectsRotatedKeyOnSecondDial guards against the
+// callback verifying against a one-time, in-memory snapshot of the known
+// hosts file taken when the callback was built: the second dial here must
+// see the key pinned by the first, not a stale "nothing pinned yet" view.
+func TestHostKeyCallbackRejectsRotatedKeyOnSecondDial(t *testing.T) {
+	cc := &Client{Config: &Config{KnownHostsFile: filepath.Join(t.TempDir(), "known_hosts")}}
+	cb, err := cc.hostKeyCallback()
+	if err != nil {
+		t.Fatalf("hostKeyCallback: %v", err)
+	}
+
+	hostname := "cloud.charm.sh:35353"
+	remote, err := net.ResolveTCPAddr("tcp", "203.0.113.10:35353")
+	if err != nil {
+		t.Fatalf("resolve test addr: %v", err)
+	}
+
+	key1 := genHostKey(t)
+	if err := cb(hostname, remote, key1); err != nil {
+		t.Fatalf("first dial: unexpected error pinning a new host key: %v", err)
+	}
+
+	// Same key again: should still be trusted.
+	if err := cb(hostname, remote, key1); err != nil {
+		t.Fatalf("second dial with the same key: unexpected error: %v", err)
+	}
+
+	key2 := genHostKey(t)
+	if err := cb(hostname, remote, key2); !errors.Is(err, ErrHostKeyChanged) {
+		t.Fatalf("dial with a rotated key: got %v, want ErrHostKeyChanged", err)
+	}
+}
+
+func TestCertAuthForIsScopedByHost(t *testing.T) {
+	a1 := certAuthFor("host-a.example.com")
+	a2 := certAuthFor("host-a.example.com")
+	if a1 != a2 {
+		t.Fatal("certAuthFor returned different entries for the same host")
+	}
+
+	b := certAuthFor("host-b.example.com")
+	if b == a1 {
+		t.Fatal("certAuthFor returned the same entry for two different hosts")
+	}
+
+	a1.Lock()
+	a1.cert = &ssh.Certificate{ValidBefore: uint64(time.Now().Add(time.Hour).Unix())}
+	a1.Unlock()
+
+	if certAuthFor("host-b.example.com").cert != nil {
+		t.Fatal("populating one host's cache leaked into another host's entry")
+	}
+}
+
+// genUserCert returns a user certificate signed by a throwaway CA, valid
+// for the given duration, along with the ephemeral private key it certifies.
+func genUserCert(t *testing.T, validFor time.Duration) (*ssh.Certificate, ed25519.PrivateKey) {
+	t.Helper()
+	_, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate CA key: %v", err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatalf("CA signer: %v", err)
+	}
+
+	_, userPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate user key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(userPriv)
+	if err != nil {
+		t.Fatalf("user signer: %v", err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          1,
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: []string{"charm"},
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(time.Now().Add(validFor).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatalf("sign cert: %v", err)
+	}
+	return cert, userPriv
+}
+
+func TestLoadPersistedCertReusesAgentHeldKey(t *testing.T) {
+	cert, userPriv := genUserCert(t, time.Hour)
+
+	dp := t.TempDir()
+	cc := &Client{Config: &Config{DataDir: dp, Host: "example.com"}}
+	dataPath, err := cc.DataPath()
+	if err != nil {
+		t.Fatalf("DataPath: %v", err)
+	}
+	if err := os.MkdirAll(dataPath, 0o700); err != nil {
+		t.Fatalf("mkdir data path: %v", err)
+	}
+	if err := cc.persistCertificate(cert); err != nil {
+		t.Fatalf("persistCertificate: %v", err)
+	}
+
+	kr := agent.NewKeyring()
+	if err := kr.Add(agent.AddedKey{PrivateKey: userPriv, Certificate: cert}); err != nil {
+		t.Fatalf("add cert to agent: %v", err)
+	}
+	extAgent, ok := kr.(agent.ExtendedAgent)
+	if !ok {
+		t.Fatal("agent.NewKeyring() does not implement agent.ExtendedAgent")
+	}
+
+	gotCert, gotSigner, err := cc.loadPersistedCert(extAgent)
+	if err != nil {
+		t.Fatalf("loadPersistedCert: %v", err)
+	}
+	if gotCert == nil || gotSigner == nil {
+		t.Fatal("loadPersistedCert returned nil, want the persisted cert and its agent-held signer")
+	}
+	if gotCert.Serial != cert.Serial {
+		t.Fatalf("loadPersistedCert cert.Serial = %d, want %d", gotCert.Serial, cert.Serial)
+	}
+}
+
+func TestLoadPersistedCertIgnoresExpiredCert(t *testing.T) {
+	cert, userPriv := genUserCert(t, -time.Hour)
+
+	dp := t.TempDir()
+	cc := &Client{Config: &Config{DataDir: dp, Host: "example.com"}}
+	dataPath, err := cc.DataPath()
+	if err != nil {
+		t.Fatalf("DataPath: %v", err)
+	}
+	if err := os.MkdirAll(dataPath, 0o700); err != nil {
+		t.Fatalf("mkdir data path: %v", err)
+	}
+	if err := cc.persistCertificate(cert); err != nil {
+		t.Fatalf("persistCertificate: %v", err)
+	}
+
+	kr := agent.NewKeyring()
+	if err := kr.Add(agent.AddedKey{PrivateKey: userPriv, Certificate: cert}); err != nil {
+		t.Fatalf("add cert to agent: %v", err)
+	}
+	extAgent := kr.(agent.ExtendedAgent)
+
+	gotCert, gotSigner, err := cc.loadPersistedCert(extAgent)
+	if err != nil {
+		t.Fatalf("loadPersistedCert: %v", err)
+	}
+	if gotCert != nil || gotSigner != nil {
+		t.Fatal("loadPersistedCert should ignore an expired certificate")
+	}
+}
+
+func TestLoadPersistedCertIgnoresWithoutAgentMatch(t *testing.T) {
+	cert, _ := genUserCert(t, time.Hour)
+
+	dp := t.TempDir()
+	cc := &Client{Config: &Config{DataDir: dp, Host: "example.com"}}
+	dataPath, err := cc.DataPath()
+	if err != nil {
+		t.Fatalf("DataPath: %v", err)
+	}
+	if err := os.MkdirAll(dataPath, 0o700); err != nil {
+		t.Fatalf("mkdir data path: %v", err)
+	}
+	if err := cc.persistCertificate(cert); err != nil {
+		t.Fatalf("persistCertificate: %v", err)
+	}
+
+	// An agent with no keys at all: the cert is unusable without its key.
+	extAgent := agent.NewKeyring().(agent.ExtendedAgent)
+
+	gotCert, gotSigner, err := cc.loadPersistedCert(extAgent)
+	if err != nil {
+		t.Fatalf("loadPersistedCert: %v", err)
+	}
+	if gotCert != nil || gotSigner != nil {
+		t.Fatal("loadPersistedCert should ignore a cert the agent can't sign with")
+	}
+}
+
+func TestLoadPersistedCertNoFile(t *testing.T) {
+	dp := t.TempDir()
+	cc := &Client{Config: &Config{DataDir: dp, Host: "example.com"}}
+	extAgent := agent.NewKeyring().(agent.ExtendedAgent)
+
+	gotCert, gotSigner, err := cc.loadPersistedCert(extAgent)
+	if err != nil {
+		t.Fatalf("loadPersistedCert: %v", err)
+	}
+	if gotCert != nil || gotSigner != nil {
+		t.Fatal("loadPersistedCert should return nothing when no cert was ever persisted")
+	}
+}
@@ -0,0 +1,234 @@
+// Package keyprovider supplies SSH signers to the Charm client from
+// pluggable sources: files on disk, a running ssh-agent, or an external
+// crypto.Signer such as a cloud KMS, PKCS#11 token, or hardware key.
+package keyprovider
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"io/ioutil"
+	"sync"
+
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// KeyProvider supplies SSH signers (and their public keys) to authenticate
+// with. The Charm client composes one or more KeyProviders when building
+// its SSH auth methods.
+type KeyProvider interface {
+	Signers() ([]ssh.Signer, error)
+	PublicKeys() ([]ssh.PublicKey, error)
+}
+
+// signerCache holds decrypted signers for the lifetime of the process, keyed
+// by expanded key path. It's shared across FileProvider instances so that
+// repeated NewClient calls don't re-decrypt (and re-prompt for the
+// passphrase of) the same encrypted key.
+var signerCache struct {
+	sync.Mutex
+	m map[string]ssh.Signer
+}
+
+// FileProvider loads signers from private key files on disk. Passphrase-
+// protected keys are decrypted via Passphrase, unless a running ssh-agent
+// already holds the matching public key, in which case the key is skipped
+// here in favor of an AgentProvider.
+type FileProvider struct {
+	// Paths are the private key files to load.
+	Paths []string
+
+	// Passphrase is called to obtain the decryption passphrase for an
+	// encrypted key at path. May be nil if none of Paths are encrypted.
+	Passphrase func(path string) ([]byte, error)
+
+	// Agent, if set, is consulted so an encrypted key already held by the
+	// agent isn't also decrypted here.
+	Agent agent.ExtendedAgent
+}
+
+// NewFileProvider returns a FileProvider for the given key paths.
+func NewFileProvider(paths []string, passphrase func(path string) ([]byte, error)) *FileProvider {
+	return &FileProvider{Paths: paths, Passphrase: passphrase}
+}
+
+// Signers implements KeyProvider.
+func (p *FileProvider) Signers() ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	for _, path := range p.Paths {
+		s, err := p.signerFor(path)
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			signers = append(signers, s)
+		}
+	}
+	return signers, nil
+}
+
+// PublicKeys implements KeyProvider.
+func (p *FileProvider) PublicKeys() ([]ssh.PublicKey, error) {
+	signers, err := p.Signers()
+	if err != nil {
+		return nil, err
+	}
+	pubs := make([]ssh.PublicKey, len(signers))
+	for i, s := range signers {
+		pubs[i] = s.PublicKey()
+	}
+	return pubs, nil
+}
+
+// signerFor loads (and caches) the signer for a single key path. It
+// returns (nil, nil) when the key is encrypted and already offered by the
+// agent, since no separate auth method is needed in that case.
+func (p *FileProvider) signerFor(path string) (ssh.Signer, error) {
+	keyPath, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signerCache.Lock()
+	if s, ok := signerCache.m[keyPath]; ok {
+		signerCache.Unlock()
+		return s, nil
+	}
+	signerCache.Unlock()
+
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		var passErr *ssh.PassphraseMissingError
+		if !errors.As(err, &passErr) {
+			return nil, err
+		}
+		if p.agentHasMatchingKey(keyPath) {
+			return nil, nil
+		}
+		if p.Passphrase == nil {
+			return nil, err
+		}
+		passphrase, err := p.Passphrase(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	signerCache.Lock()
+	if signerCache.m == nil {
+		signerCache.m = make(map[string]ssh.Signer)
+	}
+	signerCache.m[keyPath] = signer
+	signerCache.Unlock()
+
+	return signer, nil
+}
+
+// agentHasMatchingKey reports whether p.Agent already holds the public key
+// paired with the private key at keyPath (keyPath + ".pub").
+func (p *FileProvider) agentHasMatchingKey(keyPath string) bool {
+	if p.Agent == nil {
+		return false
+	}
+	pubBytes, err := ioutil.ReadFile(keyPath + ".pub")
+	if err != nil {
+		return false
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pubBytes)
+	if err != nil {
+		return false
+	}
+	keys, err := p.Agent.List()
+	if err != nil {
+		return false
+	}
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), pub.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// AgentProvider defers entirely to the keys already loaded in a running
+// ssh-agent.
+type AgentProvider struct {
+	Agent agent.ExtendedAgent
+}
+
+// NewAgentProvider returns an AgentProvider backed by the given agent
+// connection.
+func NewAgentProvider(a agent.ExtendedAgent) *AgentProvider {
+	return &AgentProvider{Agent: a}
+}
+
+// Signers implements KeyProvider.
+func (p *AgentProvider) Signers() ([]ssh.Signer, error) {
+	return p.Agent.Signers()
+}
+
+// PublicKeys implements KeyProvider.
+func (p *AgentProvider) PublicKeys() ([]ssh.PublicKey, error) {
+	keys, err := p.Agent.List()
+	if err != nil {
+		return nil, err
+	}
+	pubs := make([]ssh.PublicKey, len(keys))
+	for i, k := range keys {
+		pubs[i] = k
+	}
+	return pubs, nil
+}
+
+// KMSProvider wraps a crypto.Signer whose private key never touches local
+// disk, e.g. one backed by a cloud KMS, a PKCS#11 token, or another
+// hardware-backed signer.
+type KMSProvider struct {
+	Signer crypto.Signer
+}
+
+// NewKMSProvider returns a KMSProvider wrapping the given crypto.Signer.
+func NewKMSProvider(s crypto.Signer) *KMSProvider {
+	return &KMSProvider{Signer: s}
+}
+
+// Signers implements KeyProvider.
+func (p *KMSProvider) Signers() ([]ssh.Signer, error) {
+	// Some KMS-backed crypto.Signer implementations (e.g. an SSH-agent-
+	// backed signer) wrap an existing ssh.Signer and expose it through an
+	// SSHSigner method. Wrapping one of those again with
+	// ssh.NewSignerFromSigner breaks with "unsupported key type", so
+	// unwrap instead of double-wrapping.
+	if w, ok := p.Signer.(interface{ SSHSigner() ssh.Signer }); ok {
+		return []ssh.Signer{w.SSHSigner()}, nil
+	}
+	signer, err := ssh.NewSignerFromSigner(p.Signer)
+	if err != nil {
+		return nil, err
+	}
+	return []ssh.Signer{signer}, nil
+}
+
+// PublicKeys implements KeyProvider.
+func (p *KMSProvider) PublicKeys() ([]ssh.PublicKey, error) {
+	signers, err := p.Signers()
+	if err != nil {
+		return nil, err
+	}
+	pubs := make([]ssh.PublicKey, len(signers))
+	for i, s := range signers {
+		pubs[i] = s.PublicKey()
+	}
+	return pubs, nil
+}
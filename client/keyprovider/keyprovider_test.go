@@ -0,0 +1,143 @@
+package keyprovider
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// writeKey generates an ed25519 key pair, writes the private key (optionally
+// passphrase-encrypted) to dir/name, and returns its path and public key.
+func writeKey(t *testing.T, dir, name string, passphrase []byte) (path string, pub ssh.PublicKey, priv ed25519.PrivateKey) {
+	t.Helper()
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	var block *pem.Block
+	if len(passphrase) == 0 {
+		block, err = ssh.MarshalPrivateKey(privKey, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(privKey, "", passphrase)
+	}
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	path = filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(privKey)
+	if err != nil {
+		t.Fatalf("signer from key: %v", err)
+	}
+	return path, signer.PublicKey(), privKey
+}
+
+func TestFileProviderSignerForUnencrypted(t *testing.T) {
+	dir := t.TempDir()
+	path, pub, _ := writeKey(t, dir, "id_ed25519", nil)
+
+	p := NewFileProvider([]string{path}, nil)
+	signers, err := p.Signers()
+	if err != nil {
+		t.Fatalf("Signers: %v", err)
+	}
+	if len(signers) != 1 || !bytes.Equal(signers[0].PublicKey().Marshal(), pub.Marshal()) {
+		t.Fatalf("unexpected signers: %+v", signers)
+	}
+}
+
+func TestFileProviderSignerForEncryptedPromptsOnce(t *testing.T) {
+	dir := t.TempDir()
+	path, pub, _ := writeKey(t, dir, "id_ed25519", []byte("s3cret"))
+
+	var prompted int
+	p := NewFileProvider([]string{path}, func(string) ([]byte, error) {
+		prompted++
+		return []byte("s3cret"), nil
+	})
+
+	for i := 0; i < 2; i++ {
+		signers, err := p.Signers()
+		if err != nil {
+			t.Fatalf("Signers: %v", err)
+		}
+		if len(signers) != 1 || !bytes.Equal(signers[0].PublicKey().Marshal(), pub.Marshal()) {
+			t.Fatalf("unexpected signers: %+v", signers)
+		}
+	}
+	if prompted != 1 {
+		t.Fatalf("passphrase callback called %d times, want 1 (cached across Signers calls)", prompted)
+	}
+}
+
+func TestFileProviderSkipsEncryptedKeyHeldByAgent(t *testing.T) {
+	dir := t.TempDir()
+	path, pub, priv := writeKey(t, dir, "id_ed25519", []byte("s3cret"))
+	if err := os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(pub), 0o644); err != nil {
+		t.Fatalf("write pub: %v", err)
+	}
+
+	kr := agent.NewKeyring()
+	if err := kr.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatalf("add key to agent: %v", err)
+	}
+	extAgent, ok := kr.(agent.ExtendedAgent)
+	if !ok {
+		t.Fatal("agent.NewKeyring() does not implement agent.ExtendedAgent")
+	}
+
+	called := false
+	p := NewFileProvider([]string{path}, func(string) ([]byte, error) {
+		called = true
+		return nil, errors.New("should not be called")
+	})
+	p.Agent = extAgent
+
+	signers, err := p.Signers()
+	if err != nil {
+		t.Fatalf("Signers: %v", err)
+	}
+	if len(signers) != 0 {
+		t.Fatalf("got %d signers, want 0 (left to the AgentProvider)", len(signers))
+	}
+	if called {
+		t.Fatal("passphrase callback should not be called when the agent already holds the key")
+	}
+}
+
+func TestAgentHasMatchingKey(t *testing.T) {
+	dir := t.TempDir()
+	path, pub, priv := writeKey(t, dir, "id_ed25519", nil)
+	if err := os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(pub), 0o644); err != nil {
+		t.Fatalf("write pub: %v", err)
+	}
+
+	kr := agent.NewKeyring()
+	if err := kr.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatalf("add key to agent: %v", err)
+	}
+	extAgent := kr.(agent.ExtendedAgent)
+
+	withAgent := &FileProvider{Agent: extAgent}
+	if !withAgent.agentHasMatchingKey(path) {
+		t.Error("expected agent holding the matching key to be detected")
+	}
+
+	withoutAgent := &FileProvider{}
+	if withoutAgent.agentHasMatchingKey(path) {
+		t.Error("expected no match without an agent configured")
+	}
+}
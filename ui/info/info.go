@@ -3,9 +3,16 @@ package info
 // Fetch a user's basic Charm account info
 
 import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+
 	"github.com/charmbracelet/bubbles/spinner"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/charm"
+	"github.com/charmbracelet/charm/client"
 	"github.com/charmbracelet/charm/ui/common"
 	te "github.com/muesli/termenv"
 )
@@ -16,32 +23,61 @@ var (
 	purpleFg = "#7571F9"
 )
 
+const (
+	maxBioAttempts = 5
+	initialBackoff = 250 * time.Millisecond
+	maxBackoff     = 4 * time.Second
+)
+
 // MSG
 
 type GotBioMsg *charm.User
 
 type errMsg error
 
+// RetryingMsg describes a GetBioWithRetry attempt that failed with a
+// retryable (non-auth) error. Update stores the latest one in
+// Model.Retrying, so the view can tell the user we're backing off and
+// trying again; it is not sent as a tea.Msg of its own.
+type RetryingMsg struct {
+	Attempt int
+	Err     error
+}
+
+// bioResultMsg carries the outcome of a single Bio fetch attempt.
+type bioResultMsg struct {
+	attempt int
+	user    *charm.User
+	err     error
+}
+
 // MODEL
 
 type Model struct {
-	Quit    bool // signals it's time to exit the whole application
-	Err     error
-	User    *charm.User
-	cc      *charm.Client
-	spinner spinner.Model
+	Quit     bool // signals it's time to exit the whole application
+	Err      error
+	User     *charm.User
+	Retrying *RetryingMsg
+	cc       *charm.Client
+	spinner  spinner.Model
+	ctx      context.Context
+	cancel   context.CancelFunc
 }
 
-func NewModel(cc *charm.Client) Model {
+func NewModel(ctx context.Context, cc *charm.Client) Model {
 	s := spinner.NewModel()
 	s.Type = spinner.Dot
 	s.ForegroundColor = common.SpinnerColor
 
+	ctx, cancel := context.WithCancel(ctx)
+
 	return Model{
 		Quit:    false,
 		User:    nil,
 		cc:      cc,
 		spinner: s,
+		ctx:     ctx,
+		cancel:  cancel,
 	}
 }
 
@@ -58,6 +94,7 @@ func Update(msg tea.Msg, m Model) (Model, tea.Cmd) {
 		case "esc":
 			fallthrough
 		case "ctrl+c":
+			m.cancel()
 			m.Quit = true
 			return m, nil
 		}
@@ -68,6 +105,20 @@ func Update(msg tea.Msg, m Model) (Model, tea.Cmd) {
 		m.Err = msg
 		m.Quit = true
 		return m, nil
+	case bioResultMsg:
+		if msg.err == nil {
+			m.User = msg.user
+			m.Retrying = nil
+			return m, nil
+		}
+		if errors.Is(msg.err, client.ErrAuthFailed) || msg.attempt >= maxBioAttempts {
+			m.Err = msg.err
+			m.Quit = true
+			return m, nil
+		}
+		retrying := RetryingMsg{Attempt: msg.attempt, Err: msg.err}
+		m.Retrying = &retrying
+		return m, retryBioAfter(m.ctx, m.cc, msg.attempt, backoff(msg.attempt))
 	case spinner.TickMsg:
 		m.spinner, cmd = spinner.Update(msg, m.spinner)
 	}
@@ -79,9 +130,25 @@ func Update(msg tea.Msg, m Model) (Model, tea.Cmd) {
 
 func View(m Model) string {
 	if m.Err != nil {
+		if errors.Is(m.Err, client.ErrHostKeyChanged) {
+			return te.String("! The Charm server's host key has changed. ").
+				Foreground(color(purpleFg)).String() +
+				"For your safety we've stopped the connection. If you were expecting " +
+				"this (e.g. a server migration), reset your known hosts and reconnect."
+		}
+		if errors.Is(m.Err, client.ErrAuthFailed) {
+			return te.String("! Authentication failed. ").Foreground(color(purpleFg)).String() +
+				"Your key may no longer be linked to this account; try re-linking it."
+		}
 		return "error: " + m.Err.Error()
 	} else if m.User == nil {
-		return spinner.View(m.spinner) + " Authenticating..."
+		s := spinner.View(m.spinner) + " Authenticating..."
+		if m.Retrying != nil {
+			s += te.String(
+				" (retrying, attempt " + strconv.Itoa(m.Retrying.Attempt+1) + ")",
+			).Foreground(color("241")).String()
+		}
+		return s
 	}
 	return bioView(m.User)
 }
@@ -101,10 +168,10 @@ func bioView(u *charm.User) string {
 
 // COMMANDS
 
-// GetBio fetches the authenticated user's bio
+// GetBio fetches the authenticated user's bio.
 func GetBio(cc *charm.Client) tea.Cmd {
 	return func() tea.Msg {
-		user, err := cc.Bio()
+		user, err := cc.Bio(context.Background())
 		if err != nil {
 			return errMsg(err)
 		}
@@ -113,6 +180,46 @@ func GetBio(cc *charm.Client) tea.Cmd {
 	}
 }
 
+// GetBioWithRetry fetches the authenticated user's bio, retrying transient
+// (non-auth) failures with exponential backoff and jitter. q/ctrl+c
+// cancels the in-flight attempt via the model's context.
+func GetBioWithRetry(ctx context.Context, cc *charm.Client) tea.Cmd {
+	return fetchBio(ctx, cc, 1)
+}
+
+func fetchBio(ctx context.Context, cc *charm.Client, attempt int) tea.Cmd {
+	return func() tea.Msg {
+		user, err := cc.Bio(ctx)
+		return bioResultMsg{attempt: attempt, user: user, err: err}
+	}
+}
+
+// retryBioAfter waits out a backoff delay, then retries the bio fetch,
+// unless ctx is cancelled first.
+func retryBioAfter(ctx context.Context, cc *charm.Client, attempt int, delay time.Duration) tea.Cmd {
+	return func() tea.Msg {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return bioResultMsg{attempt: attempt, err: ctx.Err()}
+		case <-t.C:
+		}
+		return fetchBio(ctx, cc, attempt+1)()
+	}
+}
+
+// backoff returns the delay before the next retry: exponential growth from
+// initialBackoff up to maxBackoff, with up to 50% jitter.
+func backoff(attempt int) time.Duration {
+	d := initialBackoff << uint(attempt-1)
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(d)/2 + 1))
+	return d/2 + jitter
+}
+
 // Tick just wraps the spinner's tick command
 func Tick(m Model) tea.Cmd {
 	return spinner.Tick(m.spinner)
@@ -0,0 +1,123 @@
+package info
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/charm"
+	"github.com/charmbracelet/charm/client"
+)
+
+func TestBackoffGrowsExponentiallyWithinBounds(t *testing.T) {
+	prevFloor := time.Duration(0)
+	for attempt := 1; attempt <= 6; attempt++ {
+		d := backoff(attempt)
+		if d <= 0 {
+			t.Fatalf("backoff(%d) = %d, want > 0", attempt, d)
+		}
+		if d > maxBackoff {
+			t.Fatalf("backoff(%d) = %s, want <= maxBackoff (%s)", attempt, d, maxBackoff)
+		}
+		// floor (pre-jitter half) should never shrink as attempts grow,
+		// since it's capped rather than wrapped once maxBackoff is hit.
+		// The floor comes from the pre-jitter delay, not from d, since
+		// backoff returns a jittered value between floor and 2*floor.
+		base := initialBackoff << uint(attempt-1)
+		if base > maxBackoff {
+			base = maxBackoff
+		}
+		floor := base / 2
+		if d < floor {
+			t.Fatalf("backoff(%d) = %s, want >= pre-jitter floor %s", attempt, d, floor)
+		}
+		if floor < prevFloor {
+			t.Fatalf("backoff(%d) floor %s is smaller than previous floor %s", attempt, floor, prevFloor)
+		}
+		prevFloor = floor
+	}
+}
+
+func TestUpdateBioResultSuccessClearsRetrying(t *testing.T) {
+	m := Model{Retrying: &RetryingMsg{Attempt: 1, Err: errors.New("boom")}}
+	got, cmd := Update(bioResultMsg{attempt: 2, user: &charm.User{}}, m)
+	if got.Retrying != nil {
+		t.Fatal("expected Retrying to be cleared on success")
+	}
+	if got.User == nil {
+		t.Fatal("expected User to be set on success")
+	}
+	if cmd != nil {
+		t.Fatal("expected no follow-up command on success")
+	}
+}
+
+func TestUpdateBioResultAuthFailureStopsRetrying(t *testing.T) {
+	m := Model{}
+	got, cmd := Update(bioResultMsg{attempt: 1, err: client.ErrAuthFailed}, m)
+	if !got.Quit {
+		t.Fatal("expected Quit to be set on auth failure")
+	}
+	if !errors.Is(got.Err, client.ErrAuthFailed) {
+		t.Fatalf("got.Err = %v, want client.ErrAuthFailed", got.Err)
+	}
+	if cmd != nil {
+		t.Fatal("expected no retry command after an auth failure")
+	}
+}
+
+func TestUpdateBioResultMaxAttemptsStopsRetrying(t *testing.T) {
+	m := Model{}
+	got, cmd := Update(bioResultMsg{attempt: maxBioAttempts, err: errors.New("still failing")}, m)
+	if !got.Quit {
+		t.Fatal("expected Quit to be set once maxBioAttempts is reached")
+	}
+	if cmd != nil {
+		t.Fatal("expected no further retry command once maxBioAttempts is reached")
+	}
+}
+
+func TestUpdateBioResultRetryableSchedulesRetry(t *testing.T) {
+	m := Model{ctx: context.Background()}
+	got, cmd := Update(bioResultMsg{attempt: 1, err: errors.New("transient")}, m)
+	if got.Quit {
+		t.Fatal("did not expect Quit for a retryable error under maxBioAttempts")
+	}
+	if got.Retrying == nil || got.Retrying.Attempt != 1 {
+		t.Fatalf("got.Retrying = %+v, want Attempt 1", got.Retrying)
+	}
+	if cmd == nil {
+		t.Fatal("expected a retry command to be scheduled")
+	}
+}
+
+func TestRetryBioAfterRespectsCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// cc is never dereferenced on the cancelled path, so nil is safe here.
+	msg := retryBioAfter(ctx, nil, 1, time.Second)()
+	result, ok := msg.(bioResultMsg)
+	if !ok {
+		t.Fatalf("retryBioAfter() returned %T, want bioResultMsg", msg)
+	}
+	if !errors.Is(result.err, context.Canceled) {
+		t.Fatalf("result.err = %v, want context.Canceled", result.err)
+	}
+}
+
+func TestViewShowsHostKeyChangedMessage(t *testing.T) {
+	m := Model{Err: client.ErrHostKeyChanged}
+	if got := View(m); !strings.Contains(got, "host key has changed") {
+		t.Fatalf("View() = %q, want a message about the changed host key", got)
+	}
+}
+
+func TestViewShowsAuthFailedMessage(t *testing.T) {
+	m := Model{Err: client.ErrAuthFailed}
+	if got := View(m); !strings.Contains(got, "Authentication failed") {
+		t.Fatalf("View() = %q, want a message about authentication failing", got)
+	}
+}